@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"gocv.io/x/gocv"
+)
+
+// frameServer streams decoded frames from a single long-running ffmpeg
+// process instead of spawning one ffmpeg per probed timestamp. It decodes
+// inputFile once and emits a raw 8-bit grayscale frame every step seconds
+// over [from,to], which findTemplate consumes in stream order. This avoids
+// both the per-sample fork/exec cost and the JPEG re-encode that the old
+// check()/getLocation() pair paid on every probe.
+type frameServer struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	r      *bufio.Reader
+	from   float64
+	step   float64
+	width  int
+	height int
+	n      int
+}
+
+// newFrameServer launches ffmpeg decoding inputFile and emitting one
+// rawvideo grayscale frame every step seconds within [from,to]. Callers
+// must call Close when done to reap the ffmpeg process.
+func newFrameServer(inputFile string, from, to, step float64) (*frameServer, error) {
+	cmd := exec.Command("ffmpeg",
+		"-loglevel", "quiet",
+		"-ss", fmt.Sprintf("%.3f", from),
+		"-i", inputFile,
+		"-t", fmt.Sprintf("%.3f", to-from),
+		"-vf", fmt.Sprintf("fps=1/%.6f,format=gray", step),
+		"-f", "rawvideo",
+		"-pix_fmt", "gray",
+		"pipe:1",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &frameServer{
+		cmd:    cmd,
+		stdout: stdout,
+		r:      bufio.NewReaderSize(stdout, 1<<20),
+		from:   from,
+		step:   step,
+		width:  videoWidth,
+		height: videoHeight,
+	}, nil
+}
+
+// Next reads the next frame off the stream along with the timestamp it was
+// sampled at, or reports ok=false once the stream is exhausted. The
+// returned Mat must be closed by the caller.
+func (fs *frameServer) Next() (second float64, mat gocv.Mat, ok bool) {
+	buf := make([]byte, fs.width*fs.height)
+	if _, err := io.ReadFull(fs.r, buf); err != nil {
+		return 0, gocv.Mat{}, false
+	}
+	m, err := gocv.NewMatFromBytes(fs.height, fs.width, gocv.MatTypeCV8UC1, buf)
+	if err != nil {
+		return 0, gocv.Mat{}, false
+	}
+	second = fs.from + float64(fs.n)*fs.step
+	fs.n++
+	return second, m, true
+}
+
+// Close drains and closes the stdout pipe and waits for ffmpeg to exit.
+func (fs *frameServer) Close() error {
+	io.Copy(io.Discard, fs.r)
+	fs.stdout.Close()
+	return fs.cmd.Wait()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// hwEncoders maps a hwaccel name to the ffmpeg encoder it expects for each
+// probed source codec.
+var hwEncoders = map[string]map[string]string{
+	"cuda":         {"h264": "h264_nvenc", "hevc": "hevc_nvenc"},
+	"videotoolbox": {"h264": "h264_videotoolbox", "hevc": "hevc_videotoolbox"},
+	"qsv":          {"h264": "h264_qsv", "hevc": "hevc_qsv"},
+	"vaapi":        {"h264": "h264_vaapi", "hevc": "hevc_vaapi"},
+}
+
+var autoOrder = []string{"cuda", "videotoolbox", "qsv", "vaapi"}
+
+// HWAccel enumerates the hwaccel/encoder capabilities ffmpeg was built with,
+// probed once at startup and cached, and knows how to thread the chosen
+// method through decode args, the boxblur filter graph and the encoder
+// name. Name "none" means everything stays on the CPU.
+type HWAccel struct {
+	Name      string
+	available map[string]bool
+}
+
+// NewHWAccel probes ffmpeg's available encoders and resolves requested
+// ("auto", "none", or one of cuda/videotoolbox/qsv/vaapi) into a concrete
+// HWAccel.
+func NewHWAccel(requested string) (*HWAccel, error) {
+	available := probeEncoders()
+	if requested == "" || requested == "none" {
+		return &HWAccel{Name: "none", available: available}, nil
+	}
+	if requested == "auto" {
+		for _, name := range autoOrder {
+			if anyEncoderAvailable(available, hwEncoders[name]) {
+				log.Println("hwaccel: auto-selected", name)
+				return &HWAccel{Name: name, available: available}, nil
+			}
+		}
+		log.Println("hwaccel: auto requested but no supported hardware encoder was found, using software")
+		return &HWAccel{Name: "none", available: available}, nil
+	}
+	if _, ok := hwEncoders[requested]; !ok {
+		return nil, fmt.Errorf("unknown -hwaccel value: %s", requested)
+	}
+	if !anyEncoderAvailable(available, hwEncoders[requested]) {
+		log.Println("hwaccel:", requested, "requested but ffmpeg reports no matching encoder, continuing anyway")
+	}
+	return &HWAccel{Name: requested, available: available}, nil
+}
+
+func anyEncoderAvailable(available map[string]bool, byCodec map[string]string) bool {
+	for _, enc := range byCodec {
+		if available[enc] {
+			return true
+		}
+	}
+	return false
+}
+
+var encoderLineRe = regexp.MustCompile(`^\s*[VAS][F.][S.][X.][B.][D.]\s+(\S+)`)
+
+// probeEncoders lists the encoders the local ffmpeg binary was built with,
+// similar to how mainstream transcoders probe capabilities once and cache
+// them instead of repeating the check per encode.
+func probeEncoders() map[string]bool {
+	available := map[string]bool{}
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return available
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := encoderLineRe.FindStringSubmatch(line); m != nil {
+			available[m[1]] = true
+		}
+	}
+	return available
+}
+
+// DecodeArgs returns the ffmpeg input-side flags needed to decode on the
+// chosen hardware, to be inserted before -i.
+func (h *HWAccel) DecodeArgs() []string {
+	switch h.Name {
+	case "cuda":
+		return []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}
+	case "videotoolbox":
+		return []string{"-hwaccel", "videotoolbox"}
+	case "qsv":
+		return []string{"-hwaccel", "qsv", "-hwaccel_output_format", "qsv"}
+	case "vaapi":
+		return []string{"-hwaccel", "vaapi", "-hwaccel_output_format", "vaapi", "-vaapi_device", "/dev/dri/renderD128"}
+	default:
+		return nil
+	}
+}
+
+// Encoder returns the hardware encoder matching codec, falling back to
+// codec itself (the software path) if there's no hwaccel or no match for
+// this codec.
+func (h *HWAccel) Encoder(codec string) string {
+	if enc, ok := hwEncoders[h.Name][codec]; ok {
+		return enc
+	}
+	return codec
+}
+
+// EncoderArgs returns the "-c:v <encoder>" flag plus any extra encoder-side
+// options the chosen hardware encoder needs, ready to append to the output
+// side of an ffmpeg command. qsv's h264_qsv/hevc_qsv need extra_hw_frames
+// raised above their low default, or encoding stalls once the hwupload
+// filter has more than a couple of frames in flight; that's an encoder
+// option (-extra_hw_frames), not a parameter hwupload itself accepts.
+func (h *HWAccel) EncoderArgs(codec string) []string {
+	args := []string{"-c:v", h.Encoder(codec)}
+	if h.Name == "qsv" {
+		args = append(args, "-extra_hw_frames", "16")
+	}
+	return args
+}
+
+// needsUpload reports whether the chosen hwaccel's encoder requires frames
+// to be explicitly uploaded back to device memory after software
+// filtering; nvenc and videotoolbox accept plain system-memory frames, qsv
+// and vaapi don't.
+func (h *HWAccel) needsUpload() bool {
+	return h.Name == "qsv" || h.Name == "vaapi"
+}
+
+func (h *HWAccel) uploadFilter() string {
+	switch h.Name {
+	case "qsv", "vaapi":
+		return "hwupload"
+	default:
+		return ""
+	}
+}
+
+// FilterChain builds the filter_complex graph that crops, boxblurs and
+// overlays every detected template location back onto the frame, one
+// overlay stage per point so several logos in the same frame are all
+// blurred in a single re-encode. Each point uses its own template's blur
+// parameters, falling back to defaultBlur when it didn't specify one. When
+// decoding happened on a hardware surface, the frame is downloaded once up
+// front (crop/boxblur only run on the CPU) and, for encoders that require
+// it, re-uploaded before encoding.
+func (h *HWAccel) FilterChain(points []*imagePoint, defaultBlur string) string {
+	// Only these DecodeArgs set -hwaccel_output_format, leaving frames on a
+	// hardware surface; videotoolbox decodes into system memory.
+	hwActive := h.Name == "cuda" || h.Name == "qsv" || h.Name == "vaapi"
+	src, bg := "[0:v]", "0:v"
+	var stages []string
+	if hwActive {
+		stages = append(stages, "[0:v]hwdownload,format=nv12[dl]")
+		src, bg = "[dl]", "dl"
+	}
+	for i, p := range points {
+		blur := p.Blur
+		if blur == "" {
+			blur = defaultBlur
+		}
+		fgLabel := fmt.Sprintf("fg%d", i)
+		stages = append(stages, fmt.Sprintf("%scrop=%d:%d:%d:%d,boxblur=%s[%s]",
+			src, p.Width, p.Height, p.X, p.Y, blur, fgLabel))
+
+		outLabel := fmt.Sprintf("bg%d", i)
+		last := i == len(points)-1
+		if last {
+			outLabel = "v"
+		}
+		overlay := fmt.Sprintf("overlay=%d:%d", p.X, p.Y)
+		if last && hwActive && h.needsUpload() {
+			overlay += "," + h.uploadFilter()
+		}
+		stages = append(stages, fmt.Sprintf("[%s][%s]%s[%s]", bg, fgLabel, overlay, outLabel))
+		bg = outLabel
+	}
+	return strings.Join(stages, "; ")
+}
@@ -8,20 +8,22 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"gocv.io/x/gocv"
 )
 
 var (
-	templates []gocv.Mat
-	inputFile string
-	dryRun    bool
-	verbosive bool
-	debug     bool
+	templates   []*loadedTemplate
+	inputFile   string
+	dryRun      bool
+	verbosive   bool
+	debug       bool
+	videoWidth  int
+	videoHeight int
 )
 
 type tplFileArg []string
@@ -45,7 +47,7 @@ func addOptions(in []string) []string {
 
 func main() {
 	var tplFiles tplFileArg
-	flag.Var(&tplFiles, "t", "template file")
+	flag.Var(&tplFiles, "t", "template file, or 'file=...;mask=...;blur=...;threshold=...;scales=...;rotations=...;method=...' (repeatable)")
 	flag.StringVar(&inputFile, "in", "", "input file")
 	outputFile := flag.String("out", "", "output file")
 	flag.BoolVar(&dryRun, "dryrun", false, "print command to stdout but don't execute them")
@@ -55,6 +57,14 @@ func main() {
 	noClean := flag.Bool("noclean", false, "don't remove intermediate files")
 	boxBlur := flag.String("boxblur", "20", "ffmpeg boxblur parameters, see https://ffmpeg.org/ffmpeg-filters.html#boxblur")
 	timeRange := flag.String("range", "", "specify time range for the first time find, hh:mm:ss-hh:mm:ss or sec-sec")
+	hlsDir := flag.String("hls", "", "write a keyframe-aligned HLS playlist and segments to this directory instead of a single output file")
+	dashDir := flag.String("dash", "", "write a keyframe-aligned DASH manifest and segments to this directory instead of a single output file")
+	samplerName := flag.String("sampler", "grid", "how to pick candidate timestamps for the first scan: grid|scene")
+	sceneThreshold := flag.Float64("scene-threshold", 0.3, "ffmpeg scene score above which a frame is treated as a scene change, used by -sampler=scene")
+	timestampsFile := flag.String("timestamps", "", "CSV file of candidate seconds to probe for the first scan, overrides -sampler")
+	subsPattern := flag.String("subs", "", "comma separated regex/literal patterns; subtitle cues matching a pattern or overlapping a detected part are redacted in the output")
+	hwaccelName := flag.String("hwaccel", "none", "hardware acceleration to use for the re-encoded parts: auto|cuda|videotoolbox|qsv|vaapi|none")
+	threshold := flag.Float64("threshold", 0.9, "default match threshold used when -t doesn't specify threshold=")
 	flag.Parse()
 
 	debug = os.Getenv("DEBUG") == "1"
@@ -63,21 +73,33 @@ func main() {
 		log.Fatal("please provide input file")
 	}
 
-	if *outputFile == "" {
+	if *outputFile == "" && *hlsDir == "" && *dashDir == "" {
 		log.Fatal("please provide output file")
 	}
 
+	if *hlsDir != "" && *dashDir != "" {
+		log.Fatal("please provide either -hls or -dash, not both")
+	}
+
 	if len(tplFiles) == 0 {
 		log.Fatal("please provide template files")
 	}
 
+	specs := make([]templateSpec, 0, len(tplFiles))
 	for _, tplFile := range tplFiles {
-		template := gocv.IMRead(tplFile, gocv.IMReadGrayScale)
-		if template.Empty() {
-			log.Fatal("invalid template file", tplFile)
+		spec, err := parseTemplateSpec(tplFile, *boxBlur, *threshold)
+		if err != nil {
+			log.Fatal(err)
 		}
-		defer template.Close()
-		templates = append(templates, template)
+		specs = append(specs, spec)
+	}
+	var err error
+	templates, err = loadTemplates(specs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, tpl := range templates {
+		defer tpl.Close()
 	}
 	log.Println("using", len(templates), "templates")
 
@@ -100,12 +122,19 @@ func main() {
 	for _, s := range result.Streams {
 		if s.CodecType == "video" {
 			videoCodec = s.CodecName
+			videoWidth = s.Width
+			videoHeight = s.Height
 		}
 	}
 	if videoCodec == "" {
 		log.Fatal("unknown video codec")
 	}
 
+	hw, err := NewHWAccel(*hwaccelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	oldStep := *firstStep
 	duration, _ := strconv.ParseFloat(result.Format.Duration, 64)
 
@@ -135,9 +164,21 @@ func main() {
 		}
 	}
 
-	log.Printf("scanning template for every %.1f seconds from %.1f (%s) to %.1f (%s)",
-		oldStep, from, secToTime(int64(from)), to, secToTime(int64(to)))
-	_, _, parts := findTemplate(generateSeries(from, to, oldStep), false)
+	var sampler Sampler
+	switch {
+	case *timestampsFile != "":
+		sampler = csvSampler{path: *timestampsFile}
+	case *samplerName == "scene":
+		sampler = sceneSampler{threshold: *sceneThreshold}
+	case *samplerName == "grid":
+		sampler = gridSampler{step: oldStep}
+	default:
+		log.Fatal("unknown sampler: ", *samplerName)
+	}
+
+	log.Printf("scanning template (sampler=%s) from %.1f (%s) to %.1f (%s)",
+		*samplerName, from, secToTime(int64(from)), to, secToTime(int64(to)))
+	_, _, parts := findTemplate(sampler, from, to, false)
 	if len(parts) == 0 {
 		log.Println("no template is found in the video")
 		log.Println("all done")
@@ -151,6 +192,9 @@ func main() {
 	intermediateFiles := []string{}
 	filesToMerge := []string{}
 	stime := []string{}
+	boundaries := []float64{0}
+	segPoints := map[int][]*imagePoint{}
+	changedRanges := [][2]float64{}
 	for partNo, part := range parts {
 		oldStep = *firstStep
 		steps := []float64{2, 0.5, 0.1}
@@ -160,7 +204,7 @@ func main() {
 			to = b.second + oldStep
 			log.Printf("part#%d: scanning template for every %.1f seconds from %.1f (%s) to %.1f (%s)",
 				partNo, step, from, secToTime(int64(from)), to, secToTime(int64(to)))
-			a, b, _ = findTemplate(generateSeries(from, to, step), true)
+			a, b, _ = findTemplateGrid(from, to, step, true)
 			oldStep = step
 		}
 		keepFile := fmt.Sprintf("part-%02d.ts", idx)
@@ -179,13 +223,38 @@ func main() {
 			changeFile,
 		)
 		stime = append(stime, fmt.Sprintf("%.2f", a.second))
-		points = append(points, indexpoint{index: idx, point: a.point})
+		points = append(points, indexpoint{index: idx, points: a.points})
 		changedFile := fmt.Sprintf("changed-%02d.ts", idx)
 		filesToMerge = append(filesToMerge, keepFile, changedFile)
+		boundaries = append(boundaries, a.second, b.second)
+		segPoints[2*partNo+1] = a.points
+		changedRanges = append(changedRanges, [2]float64{a.second, b.second})
 		s = b.second
 		stime = append(stime, fmt.Sprintf("%.2f", s))
 		idx += 1
 	}
+	boundaries = append(boundaries, duration)
+
+	if *hlsDir != "" || *dashDir != "" {
+		format, outDir := "hls", *hlsDir
+		if *dashDir != "" {
+			format, outDir = "dash", *dashDir
+		}
+		if *subsPattern != "" {
+			log.Println("-subs is not supported in -hls/-dash segmented output mode, subtitle tracks are left untouched")
+		}
+		sg, err := NewSegmenter(format, outDir, ffmpeg, videoCodec, *boxBlur, hw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("segmenting video at time (before keyframe snapping):", boundaries)
+		if err := sg.Run(inputFile, boundaries, segPoints); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("all done")
+		return
+	}
+
 	keepFile := fmt.Sprintf("part-%02d.ts", idx)
 	keep = append(keep, "-ss", fmt.Sprintf("%.2f", s), "-codec", "copy", keepFile)
 	filesToMerge = append(filesToMerge, keepFile)
@@ -193,21 +262,72 @@ func main() {
 	runCommand(keep)
 	runCommand(change)
 	for _, p := range points {
-		filter := fmt.Sprintf("[0:v]crop=%d:%d:%d:%d,boxblur=%s[fg]; [0:v][fg]overlay=%d:%d[v]",
-			p.point.Width, p.point.Height, p.point.X, p.point.Y, *boxBlur, p.point.X, p.point.Y)
-		cmd := append(addOptions(append(ffmpeg, "-i", fmt.Sprintf("change-%02d.ts", p.index))),
+		filter := hw.FilterChain(p.points, *boxBlur)
+		base := append(append([]string{}, ffmpeg...), hw.DecodeArgs()...)
+		cmd := append(addOptions(append(base, "-i", fmt.Sprintf("change-%02d.ts", p.index))),
 			"-filter_complex", filter,
 			"-map", "[v]", "-map", "0:a",
-			"-c:v", videoCodec, "-c:a", "copy",
-			fmt.Sprintf("changed-%02d.ts", p.index),
 		)
-		log.Printf("applying (boxblur=%s) filter at (%d, %d)", *boxBlur, p.point.X, p.point.Y)
+		cmd = append(cmd, hw.EncoderArgs(videoCodec)...)
+		cmd = append(cmd, "-c:a", "copy", fmt.Sprintf("changed-%02d.ts", p.index))
+		log.Printf("applying %d blur overlay(s) at part#%d", len(p.points), p.index)
 		runCommand(cmd)
 	}
 	log.Println("merging videos to", *outputFile)
 	concat := append(addOptions(append(ffmpeg, "-i", "concat:"+strings.Join(filesToMerge, "|"))),
 		"-c", "copy", *outputFile)
 	runCommand(concat)
+	if *subsPattern != "" && dryRun {
+		log.Println("would redact subtitles matching", *subsPattern)
+	} else if *subsPattern != "" {
+		subIndexes := []int{}
+		for _, st := range result.Streams {
+			if st.CodecType == "subtitle" {
+				subIndexes = append(subIndexes, st.Index)
+			}
+		}
+		if len(subIndexes) == 0 {
+			log.Println("-subs given but no subtitle stream found, skipping")
+		}
+		outExt := strings.ToLower(strings.TrimPrefix(filepath.Ext(*outputFile), "."))
+		subtitleCodec, muxable := subtitleCodecForContainer(outExt)
+		if len(subIndexes) > 0 && !muxable {
+			log.Println("-subs given but output container", outExt, "can't carry a muxed subtitle track, writing redacted subtitles as .srt sidecar file(s) instead")
+		}
+		current := *outputFile
+		for i, streamIndex := range subIndexes {
+			sub, err := NewSubtitle(streamIndex, *subsPattern)
+			if err != nil {
+				log.Fatal(err)
+			}
+			srtFile := fmt.Sprintf("subs-%02d.srt", i)
+			redactedFile := fmt.Sprintf("subs-%02d.redacted.srt", i)
+			sub.Extract(ffmpeg, inputFile, srtFile)
+			if err := sub.Redact(srtFile, redactedFile, changedRanges); err != nil {
+				log.Fatal(err)
+			}
+			intermediateFiles = append(intermediateFiles, srtFile)
+			if !muxable {
+				sidecar := strings.TrimSuffix(*outputFile, filepath.Ext(*outputFile)) + fmt.Sprintf(".%d.srt", streamIndex)
+				if err := os.Rename(redactedFile, sidecar); err != nil {
+					log.Fatal(err)
+				}
+				continue
+			}
+			muxedFile := fmt.Sprintf("muxed-%02d%s", i, filepath.Ext(*outputFile))
+			sub.Mux(ffmpeg, current, redactedFile, muxedFile, subtitleCodec)
+			intermediateFiles = append(intermediateFiles, redactedFile)
+			if current != *outputFile {
+				intermediateFiles = append(intermediateFiles, current)
+			}
+			current = muxedFile
+		}
+		if muxable && current != *outputFile {
+			if err := os.Rename(current, *outputFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	if *noClean == false {
 		intermediateFiles = append(intermediateFiles, filesToMerge...)
 		for _, file := range intermediateFiles {
@@ -247,18 +367,19 @@ type (
 	}
 
 	indexpoint struct {
-		index int
-		point *imagePoint
+		index  int
+		points []*imagePoint
 	}
 
 	timepoint struct {
 		second float64
-		point  *imagePoint
+		points []*imagePoint
 	}
 
 	imagePoint struct {
 		Width  int
 		Height int
+		Blur   string
 		*image.Point
 	}
 )
@@ -268,119 +389,127 @@ func (tp *timepoint) String() string {
 		return "(nil)"
 	}
 	if debug {
-		str := "&timepoint{second: " + strconv.FormatFloat(tp.second, 'f', 2, 64) + ", point: "
-		if tp.point == nil {
-			str += "nil"
-		} else {
-			str += "&image.Point{X: " + strconv.Itoa(tp.point.X) + ", Y: " + strconv.Itoa(tp.point.Y) + "}"
+		str := "&timepoint{second: " + strconv.FormatFloat(tp.second, 'f', 2, 64) + ", points: ["
+		for i, p := range tp.points {
+			if i > 0 {
+				str += ", "
+			}
+			str += "&image.Point{X: " + strconv.Itoa(p.X) + ", Y: " + strconv.Itoa(p.Y) + "}"
 		}
-		str += "}"
+		str += "]}"
 		return str
 	}
-	return secToTime(int64(tp.second)) +
-		"@(" + strconv.Itoa(tp.point.X) + "," + strconv.Itoa(tp.point.Y) + ")"
+	str := secToTime(int64(tp.second))
+	for _, p := range tp.points {
+		str += "@(" + strconv.Itoa(p.X) + "," + strconv.Itoa(p.Y) + ")"
+	}
+	return str
 }
 
-// Find template image at every specified second of the video and return
-// matching time ranges and image locations.  Commands are executed one by one
-// from the beginning and end of the video to the middle, therefore the seconds
-// must be sorted in ascending order.  At most one time range is returned when
-// getOne is true.
-//
-// 在视频的每一指定秒数时间上查找模板图像并返回匹配的时间范围和图像位置。
-// 命令是从视频的头尾向中间时间逐个执行的，所以 seconds 必须从小到大排序。
-// getOne 为 true 时返回最多一个时间范围。
+// findTemplate selects candidate seconds between from and to via sampler
+// and returns matching time ranges and image locations. At most one time
+// range is returned when getOne is true, but the whole range is still
+// probed once so that both its leading and trailing edge can be reported.
 //
-func findTemplate(seconds []float64, getOne bool) (na, nb *timepoint, parts [][]*timepoint) {
-	chan1 := make(chan float64)
-	chan2 := make(chan float64)
-	half := len(seconds) / 2
-	go func() {
-		for _, second := range seconds[:half] {
-			chan1 <- second
-		}
-		close(chan1)
-	}()
-	go func() {
-		arr := seconds[half:]
-		for i := len(arr) - 1; i > -1; i-- {
-			chan2 <- arr[i]
+// 通过 sampler 在 from 到 to 之间选取候选秒数并返回匹配的时间范围和图像位置。
+// getOne 为 true 时返回最多一个时间范围，但仍会扫描整个范围以便同时得到该范围
+// 内的起止边界。
+func findTemplate(sampler Sampler, from, to float64, getOne bool) (na, nb *timepoint, parts [][]*timepoint) {
+	if g, ok := sampler.(gridSampler); ok {
+		return findTemplateGrid(from, to, g.step, getOne)
+	}
+	seconds, err := sampler.Samples(from, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return findTemplateAt(seconds, getOne)
+}
+
+// findTemplateGrid is the fast path for a uniform grid: it streams frames
+// in order from a single frameServer rather than probing each candidate
+// second individually, so from and to are scanned forward rather than
+// sought one at a time.
+func findTemplateGrid(from, to, step float64, getOne bool) (na, nb *timepoint, parts [][]*timepoint) {
+	fs, err := newFrameServer(inputFile, from, to, step)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	var ia [][]*timepoint
+	var old bool
+	for {
+		second, mat, ok := fs.Next()
+		if !ok {
+			break
 		}
-		close(chan2)
-	}()
-	var ia, ib [][]*timepoint
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		var old bool
-		for second := range chan1 {
-			point := check(second)
-			ok := point != nil
-			if ok {
-				if na == nil {
-					na = &timepoint{
-						second: second,
-						point:  point,
-					}
-				}
-				if getOne {
-					return
-				}
+		points := locateInMat(second, mat)
+		mat.Close()
+		found := len(points) > 0
+		if found {
+			tp := &timepoint{second: second, points: points}
+			if na == nil {
+				na = tp
+			}
+			nb = tp
+			if !getOne {
 				if old {
-					ia[len(ia)-1][1] = &timepoint{
-						second: second,
-						point:  point,
-					}
-
+					ia[len(ia)-1][1] = tp
 				} else {
-					tp := &timepoint{
-						second: second,
-						point:  point,
-					}
 					ia = append(ia, []*timepoint{tp, tp})
 				}
 			}
-			old = ok
 		}
-	}()
-	go func() {
-		defer wg.Done()
-		var old bool
-		for second := range chan2 {
-			point := check(second)
-			ok := point != nil
-			if ok {
-				if nb == nil {
-					nb = &timepoint{
-						second: second,
-						point:  point,
-					}
-				}
-				if getOne {
-					return
-				}
+		old = found
+	}
+	if getOne {
+		parts = append(parts, []*timepoint{na, nb})
+	} else {
+		parts = ia
+	}
+	if na == nil && nb != nil {
+		na = nb
+	} else if na != nil && nb == nil {
+		nb = na
+	}
+	if verbosive {
+		if getOne {
+			log.Println("range:", na, nb)
+		} else {
+			log.Println("found", len(parts), "parts:", parts)
+		}
+	}
+	return
+}
+
+// findTemplateAt probes the given seconds individually (in ascending
+// order) rather than streaming a uniform grid, for use with sparse
+// samplers such as scene or csv where the candidates aren't evenly spaced.
+func findTemplateAt(seconds []float64, getOne bool) (na, nb *timepoint, parts [][]*timepoint) {
+	var ia [][]*timepoint
+	var old bool
+	for _, second := range seconds {
+		points := probeAt(second)
+		found := len(points) > 0
+		if found {
+			tp := &timepoint{second: second, points: points}
+			if na == nil {
+				na = tp
+			}
+			nb = tp
+			if !getOne {
 				if old {
-					ib[0][0] = &timepoint{
-						second: second,
-						point:  point,
-					}
+					ia[len(ia)-1][1] = tp
 				} else {
-					tp := &timepoint{
-						second: second,
-						point:  point,
-					}
-					ib = append([][]*timepoint{{tp, tp}}, ib...)
+					ia = append(ia, []*timepoint{tp, tp})
 				}
 			}
-			old = ok
 		}
-	}()
-	wg.Wait()
+		old = found
+	}
 	if getOne {
 		parts = append(parts, []*timepoint{na, nb})
 	} else {
-		parts = append(ia, ib...)
+		parts = ia
 	}
 	if na == nil && nb != nil {
 		na = nb
@@ -397,52 +526,59 @@ func findTemplate(seconds []float64, getOne bool) (na, nb *timepoint, parts [][]
 	return
 }
 
-// Find template image at specified second of the video. Image position is
-// returned if image exists, otherwise nil.
-func check(second float64) *imagePoint {
-	ffmpeg := exec.Command("ffmpeg",
-		"-ss", fmt.Sprintf("%.2f", second), "-i", inputFile,
-		"-frames:v", "1", "-f", "image2", "pipe:1")
-	jpeg, err := ffmpeg.Output()
-	if verbosive {
-		if err != nil {
-			log.Println(ffmpeg, "failed", err)
-		} else {
-			log.Println("command", ffmpeg, "success")
-		}
-	}
+// probeAt pulls the single frame at second through a narrow-range
+// frameServer and matches it against the loaded templates.
+func probeAt(second float64) []*imagePoint {
+	const epsilon = 0.04
+	fs, err := newFrameServer(inputFile, second, second+epsilon, epsilon)
 	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	s, mat, ok := fs.Next()
+	if !ok {
 		return nil
 	}
-	return getLocation(second, jpeg)
+	defer mat.Close()
+	return locateInMat(s, mat)
 }
 
-func getLocation(second float64, file []byte) (loc *imagePoint) {
-	src, err := gocv.IMDecode(file, gocv.IMReadGrayScale)
-	if err != nil || src.Empty() {
-		return nil
-	}
-	defer src.Close()
+// locateInMat matches every loaded template (at every scale/rotation in
+// its pyramid, optionally using its alpha mask) against src and returns
+// one imagePoint per template whose best-scoring variant clears that
+// template's own threshold, so multiple distinct logos in the same frame
+// are all reported. second is only used for log messages.
+func locateInMat(second float64, src gocv.Mat) []*imagePoint {
 	result := gocv.NewMat()
 	defer result.Close()
-	m := gocv.NewMat()
-	defer m.Close()
-	for _, template := range templates {
-		gocv.MatchTemplate(src, template, &result, gocv.TmCcoeffNormed, m)
-		_, maxVal, _, maxLoc := gocv.MinMaxLoc(result)
-		if maxVal > 0.9 {
-			if verbosive {
-				log.Println("found template at:", second, "("+secToTime(int64(second))+")",
-					"position:", maxLoc, "score:", maxVal)
+	var found []*imagePoint
+	for _, tpl := range templates {
+		var bestVal float32
+		var bestLoc image.Point
+		var bestVariant templateVariant
+		var hasBest bool
+		for _, variant := range tpl.variants {
+			matchTemplate(src, variant.mat, &result, tpl.spec.method, variant.mask)
+			_, maxVal, _, maxLoc := gocv.MinMaxLoc(result)
+			if !hasBest || maxVal > bestVal {
+				bestVal, bestLoc, bestVariant, hasBest = maxVal, maxLoc, variant, true
 			}
-			return &imagePoint{
-				Width:  template.Cols(),
-				Height: template.Rows(),
-				Point:  &maxLoc,
+		}
+		if hasBest && float64(bestVal) > tpl.spec.threshold {
+			if verbosive {
+				log.Println("found template", tpl.spec.path, "at:", second, "("+secToTime(int64(second))+")",
+					"position:", bestLoc, "score:", bestVal)
 			}
+			loc := bestLoc
+			found = append(found, &imagePoint{
+				Width:  bestVariant.width,
+				Height: bestVariant.height,
+				Blur:   tpl.spec.blur,
+				Point:  &loc,
+			})
 		}
 	}
-	return nil
+	return found
 }
 
 func runCommand(cmd []string) {
@@ -0,0 +1,13 @@
+//go:build !cuda
+
+package main
+
+import "gocv.io/x/gocv"
+
+// matchTemplate runs template matching on the CPU via gocv.MatchTemplate.
+// mask may be an empty Mat, in which case matching is unmasked. Build with
+// -tags cuda to use the GPU-backed implementation in matcher_cuda.go
+// instead.
+func matchTemplate(src, tpl gocv.Mat, result *gocv.Mat, method gocv.TemplateMatchMode, mask gocv.Mat) {
+	gocv.MatchTemplate(src, tpl, result, method, mask)
+}
@@ -0,0 +1,29 @@
+//go:build cuda
+
+package main
+
+import (
+	"gocv.io/x/gocv"
+	"gocv.io/x/gocv/cuda"
+)
+
+// matchTemplate runs template matching on the GPU through gocv's CUDA
+// bindings. cuda.TemplateMatching doesn't support a mask, so mask is
+// ignored here; build without -tags cuda (the default matcher.go) if a
+// masked template needs to match exactly. Only built when ffblur is
+// compiled with -tags cuda, since gocv/cuda requires OpenCV built with
+// CUDA support.
+func matchTemplate(src, tpl gocv.Mat, result *gocv.Mat, method gocv.TemplateMatchMode, mask gocv.Mat) {
+	gSrc := cuda.NewGpuMat()
+	defer gSrc.Close()
+	gTpl := cuda.NewGpuMat()
+	defer gTpl.Close()
+	gResult := cuda.NewGpuMat()
+	defer gResult.Close()
+	gSrc.Upload(src)
+	gTpl.Upload(tpl)
+	matcher := cuda.NewTemplateMatching(src.Type(), method)
+	defer matcher.Close()
+	matcher.Match(gSrc, gTpl, &gResult)
+	gResult.Download(result)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sampler picks the candidate seconds to probe for a template match between
+// from and to, in ascending order. It replaces the old fixed -step grid as
+// the source of candidates for the first, coarse scan; the per-part
+// refinement passes in main always use a grid regardless of which Sampler
+// was selected, since they're bisecting a range already known to contain a
+// transition.
+type Sampler interface {
+	Samples(from, to float64) ([]float64, error)
+}
+
+// gridSampler probes every step seconds, same as the original behavior.
+type gridSampler struct {
+	step float64
+}
+
+func (g gridSampler) Samples(from, to float64) ([]float64, error) {
+	return generateSeries(from, to, g.step), nil
+}
+
+// sceneSampler probes ffmpeg-detected scene changes instead of a fixed
+// grid. Candidates cluster around the places the video actually changes,
+// so far fewer probes are needed to find where a template starts or stops
+// appearing than a -step grid over the whole range; the existing
+// {2, 0.5, 0.1}-second refinement passes in main still do the final
+// bisection, pinpointing the exact transition, once a part is found
+// between two consecutive candidates. Stream keyframes are deliberately
+// not added here: there's roughly one per GOP, so folding them in as
+// extra candidates turns this into one ffmpeg probe per keyframe across
+// the whole video -- the exact per-timestamp spawn cost the frameserver
+// (frameserver.go) exists to avoid.
+type sceneSampler struct {
+	threshold float64
+}
+
+func (s sceneSampler) Samples(from, to float64) ([]float64, error) {
+	scenes, err := sceneChanges(inputFile, from, to, s.threshold)
+	if err != nil {
+		return nil, err
+	}
+	seconds := append(scenes, from, to)
+	return uniqueSorted(seconds, from, to), nil
+}
+
+// sceneChanges returns the timestamps, in seconds, of frames ffmpeg's scene
+// detection filter flags as a scene change with a score above threshold.
+func sceneChanges(inputFile string, from, to, threshold float64) ([]float64, error) {
+	cmd := exec.Command("ffmpeg",
+		"-loglevel", "info",
+		"-ss", fmt.Sprintf("%.3f", from),
+		"-i", inputFile,
+		"-t", fmt.Sprintf("%.3f", to-from),
+		"-vf", fmt.Sprintf("select='gt(scene,%.3f)',showinfo", threshold),
+		"-f", "null", "-",
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+	}
+	re := regexp.MustCompile(`pts_time:([0-9.]+)`)
+	var out []float64
+	for _, m := range re.FindAllStringSubmatch(stderr.String(), -1) {
+		if t, err := strconv.ParseFloat(m[1], 64); err == nil {
+			out = append(out, from+t)
+		}
+	}
+	return out, nil
+}
+
+// csvSampler loads candidate seconds from an externally computed CSV file,
+// one value (or comma-separated row whose first column is the second) per
+// line. This is useful for CI pipelines that already know shot boundaries.
+type csvSampler struct {
+	path string
+}
+
+func (c csvSampler) Samples(from, to float64) ([]float64, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var seconds []float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		field := strings.SplitN(line, ",", 2)[0]
+		second, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			log.Println("timestamps: skipping invalid line:", line)
+			continue
+		}
+		seconds = append(seconds, second)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return uniqueSorted(seconds, from, to), nil
+}
+
+// uniqueSorted sorts seconds ascending, drops duplicates and anything
+// outside [from,to].
+func uniqueSorted(seconds []float64, from, to float64) []float64 {
+	sort.Float64s(seconds)
+	out := seconds[:0]
+	var last float64
+	var hasLast bool
+	for _, s := range seconds {
+		if s < from || s > to {
+			continue
+		}
+		if hasLast && s == last {
+			continue
+		}
+		out = append(out, s)
+		last, hasLast = s, true
+	}
+	return out
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Segmenter splits the input into keyframe-aligned segments, stream-copying
+// the segments that don't overlap a detected part and re-encoding (with the
+// boxblur overlay) the ones that do, then writes a manifest (HLS playlist or
+// DASH MPD) referencing the emitted segments. This lets ffblur be used as a
+// redaction step ahead of adaptive streaming packaging instead of only
+// producing a single re-muxed file.
+type Segmenter struct {
+	format     string // "hls" or "dash"
+	outDir     string
+	ffmpeg     []string
+	videoCodec string
+	boxBlur    string
+	hw         *HWAccel
+}
+
+// NewSegmenter creates a Segmenter that writes segments and a manifest in
+// format ("hls" or "dash") into outDir, creating it if necessary.
+func NewSegmenter(format, outDir string, ffmpeg []string, videoCodec, boxBlur string, hw *HWAccel) (*Segmenter, error) {
+	if format != "hls" && format != "dash" {
+		return nil, fmt.Errorf("unknown segmenter format: %s", format)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	return &Segmenter{format: format, outDir: outDir, ffmpeg: ffmpeg, videoCodec: videoCodec, boxBlur: boxBlur, hw: hw}, nil
+}
+
+// keyframes returns the presentation timestamps, in seconds and in
+// ascending order, of every keyframe in inputFile. It shells out to ffprobe
+// with -skip_frame nokey so only I-frames are decoded.
+func keyframes(inputFile string) ([]float64, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "quiet",
+		"-skip_frame", "nokey",
+		"-select_streams", "v",
+		"-show_frames",
+		"-show_entries", "frame=pkt_pts_time",
+		"-print_format", "json",
+		inputFile,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Frames []struct {
+			PktPtsTime string `json:"pkt_pts_time"`
+		} `json:"frames"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+	times := make([]float64, 0, len(result.Frames))
+	for _, f := range result.Frames {
+		t, err := strconv.ParseFloat(f.PktPtsTime, 64)
+		if err != nil {
+			continue
+		}
+		times = append(times, t)
+	}
+	return times, nil
+}
+
+// snapToKeyframe returns the latest keyframe at or before t, so a segment
+// starting there can be stream-copied without re-encoding.
+func snapToKeyframe(kfs []float64, t float64) float64 {
+	snapped := t
+	for _, kf := range kfs {
+		if kf > t {
+			break
+		}
+		snapped = kf
+	}
+	return snapped
+}
+
+// ceilToKeyframe returns the earliest keyframe at or after t, so a segment
+// ending there doesn't cut off content that's still within the redacted
+// range; flooring an end boundary instead would push the trailing frames
+// of a detected part into the next, stream-copied (unblurred) segment.
+// Returns t unchanged if no keyframe at or after t exists, e.g. t is the
+// file's duration.
+func ceilToKeyframe(kfs []float64, t float64) float64 {
+	for _, kf := range kfs {
+		if kf >= t {
+			return kf
+		}
+	}
+	return t
+}
+
+// Run splits inputFile at splits (snapped to a keyframe), re-encodes
+// the segments named in changePoints with the boxblur overlay(s) at the
+// given image location(s), stream-copies the rest, and writes the manifest.
+// changePoints is keyed by segment index. Boundaries are floored to the
+// latest keyframe at or before them, except that a boundary that ends a
+// changed segment is snapped forward to the next keyframe instead, so
+// the blurred segment isn't cut short of where the detection actually ends.
+func (sg *Segmenter) Run(inputFile string, splits []float64, changePoints map[int][]*imagePoint) error {
+	kfs, err := keyframes(inputFile)
+	if err != nil {
+		return fmt.Errorf("probing keyframes: %w", err)
+	}
+	bounds := make([]float64, len(splits))
+	for i, t := range splits {
+		if i > 0 {
+			if _, changed := changePoints[i-1]; changed {
+				bounds[i] = ceilToKeyframe(kfs, t)
+				continue
+			}
+		}
+		bounds[i] = snapToKeyframe(kfs, t)
+	}
+	segments := make([]string, 0, len(bounds)-1)
+	for i := 0; i < len(bounds)-1; i++ {
+		start, end := bounds[i], bounds[i+1]
+		segFile := fmt.Sprintf("segment-%03d.ts", i)
+		p, changed := changePoints[i]
+		base := append([]string{}, sg.ffmpeg...)
+		if changed {
+			base = append(base, sg.hw.DecodeArgs()...)
+		}
+		cmd := append(addOptions(append(base, "-i", inputFile)),
+			"-ss", fmt.Sprintf("%.3f", start), "-t", fmt.Sprintf("%.3f", end-start))
+		if changed {
+			filter := sg.hw.FilterChain(p, sg.boxBlur)
+			cmd = append(cmd, "-filter_complex", filter, "-map", "[v]", "-map", "0:a")
+			cmd = append(cmd, sg.hw.EncoderArgs(sg.videoCodec)...)
+			cmd = append(cmd, "-c:a", "copy")
+		} else {
+			cmd = append(cmd, "-c", "copy")
+		}
+		cmd = append(cmd, filepath.Join(sg.outDir, segFile))
+		log.Printf("segment#%d: %.3f-%.3f (%d overlay(s))", i, start, end, len(changePoints[i]))
+		runCommand(cmd)
+		segments = append(segments, segFile)
+	}
+	if sg.format == "dash" {
+		return sg.writeDASH(segments, bounds)
+	}
+	return sg.writeHLS(segments, bounds)
+}
+
+func (sg *Segmenter) writeHLS(segments []string, bounds []float64) error {
+	f, err := os.Create(filepath.Join(sg.outDir, "index.m3u8"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	maxDur := 0.0
+	for i := range segments {
+		if d := bounds[i+1] - bounds[i]; d > maxDur {
+			maxDur = d
+		}
+	}
+	fmt.Fprintln(w, "#EXTM3U")
+	fmt.Fprintln(w, "#EXT-X-VERSION:3")
+	fmt.Fprintf(w, "#EXT-X-TARGETDURATION:%d\n", int(maxDur)+1)
+	fmt.Fprintln(w, "#EXT-X-PLAYLIST-TYPE:VOD")
+	for i, seg := range segments {
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n%s\n", bounds[i+1]-bounds[i], seg)
+	}
+	fmt.Fprintln(w, "#EXT-X-ENDLIST")
+	return w.Flush()
+}
+
+func (sg *Segmenter) writeDASH(segments []string, bounds []float64) error {
+	f, err := os.Create(filepath.Join(sg.outDir, "index.mpd"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	total := 0.0
+	if len(bounds) > 0 {
+		total = bounds[len(bounds)-1] - bounds[0]
+	}
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintf(w, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT%.3fS">`+"\n", total)
+	fmt.Fprintln(w, "  <Period>")
+	fmt.Fprintln(w, `    <AdaptationSet mimeType="video/mp2t" segmentAlignment="true">`)
+	fmt.Fprintln(w, "      <SegmentList>")
+	for i, seg := range segments {
+		fmt.Fprintf(w, `        <SegmentURL media="%s" duration="%.3f"/>`+"\n", seg, bounds[i+1]-bounds[i])
+	}
+	fmt.Fprintln(w, "      </SegmentList>")
+	fmt.Fprintln(w, "    </AdaptationSet>")
+	fmt.Fprintln(w, "  </Period>")
+	fmt.Fprintln(w, "</MPD>")
+	return w.Flush()
+}
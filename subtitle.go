@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// subtitleCue is one parsed SubRip (SRT) cue.
+type subtitleCue struct {
+	index      int
+	start, end float64
+	text       string
+}
+
+// Subtitle extracts a subtitle stream from the input, redacts cues that
+// either match one of a set of patterns or overlap a detected (blurred)
+// video time range, and re-muxes the result into the final output. This
+// lets ffblur strip on-screen identifiers from captions as well as pixels
+// in a single pass, for SRT, WebVTT and ISOBMFF wvtt/stpp tracks alike --
+// ffmpeg transcodes all of them to SRT on extraction.
+type Subtitle struct {
+	streamIndex int
+	patterns    []*regexp.Regexp
+}
+
+// NewSubtitle compiles patterns (comma separated regexes or literal
+// strings) used to redact cues of the subtitle stream at streamIndex.
+func NewSubtitle(streamIndex int, patterns string) (*Subtitle, error) {
+	var res []*regexp.Regexp
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -subs pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return &Subtitle{streamIndex: streamIndex, patterns: res}, nil
+}
+
+// Extract pulls the subtitle stream out of inputFile into srtFile.
+func (s *Subtitle) Extract(ffmpeg []string, inputFile, srtFile string) {
+	cmd := append(addOptions(append(append([]string{}, ffmpeg...), "-i", inputFile)),
+		"-map", fmt.Sprintf("0:%d", s.streamIndex), "-c:s", "srt", srtFile)
+	runCommand(cmd)
+}
+
+// Redact parses srtFile, replaces the text of any cue matching one of
+// s.patterns or overlapping a range in changedRanges with "[redacted]", and
+// writes the result to outFile.
+func (s *Subtitle) Redact(srtFile, outFile string, changedRanges [][2]float64) error {
+	cues, err := parseSRT(srtFile)
+	if err != nil {
+		return err
+	}
+	for i := range cues {
+		if s.matches(cues[i].text) || overlapsAny(cues[i], changedRanges) {
+			cues[i].text = "[redacted]"
+		}
+	}
+	return writeSRT(outFile, cues)
+}
+
+func (s *Subtitle) matches(text string) bool {
+	for _, re := range s.patterns {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func overlapsAny(cue subtitleCue, ranges [][2]float64) bool {
+	for _, r := range ranges {
+		if cue.start < r[1] && cue.end > r[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// Mux re-muxes srtFile as a soft subtitle track alongside videoFile,
+// producing outputFile, encoding the subtitle track as subtitleCodec (see
+// subtitleCodecForContainer).
+func (s *Subtitle) Mux(ffmpeg []string, videoFile, srtFile, outputFile, subtitleCodec string) {
+	cmd := append(addOptions(append(append([]string{}, ffmpeg...), "-i", videoFile, "-i", srtFile)),
+		"-map", "0", "-map", "1", "-c", "copy", "-c:s", subtitleCodec, outputFile)
+	runCommand(cmd)
+}
+
+// subtitleCodecForContainer returns the ffmpeg subtitle codec to use for a
+// soft subtitle track in the given output container (its -out extension,
+// without the dot), and whether that container can carry a muxed text
+// subtitle track at all. mov_text only works in MP4/MOV; mpegts (the .ts
+// container ffblur's own intermediates use) has no text subtitle support,
+// so callers should fall back to writing a sidecar .srt file instead of
+// muxing when ok is false.
+func subtitleCodecForContainer(ext string) (codec string, ok bool) {
+	switch ext {
+	case "mp4", "m4v", "mov":
+		return "mov_text", true
+	case "mkv", "webm":
+		return "srt", true
+	default:
+		return "", false
+	}
+}
+
+var srtTimeRe = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}[,.]\d{3})\s*-->\s*(\d{2}:\d{2}:\d{2}[,.]\d{3})`)
+
+// parseSRT reads a SubRip file into cues.
+func parseSRT(path string) ([]subtitleCue, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cues []subtitleCue
+	var cur subtitleCue
+	var textLines []string
+	var inCue bool
+	flush := func() {
+		if inCue {
+			cur.text = strings.Join(textLines, "\n")
+			cues = append(cues, cur)
+		}
+		cur = subtitleCue{}
+		textLines = nil
+		inCue = false
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case srtTimeRe.MatchString(line):
+			m := srtTimeRe.FindStringSubmatch(line)
+			cur.start = parseSRTTime(m[1])
+			cur.end = parseSRTTime(m[2])
+			inCue = true
+		case !inCue:
+			if idx, err := strconv.Atoi(strings.TrimSpace(line)); err == nil {
+				cur.index = idx
+			}
+		default:
+			textLines = append(textLines, line)
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cues, nil
+}
+
+func parseSRTTime(s string) float64 {
+	s = strings.Replace(s, ",", ".", 1)
+	var h, m int
+	var sec float64
+	fmt.Sscanf(s, "%d:%d:%f", &h, &m, &sec)
+	return float64(h)*3600 + float64(m)*60 + sec
+}
+
+func formatSRTTime(t float64) string {
+	h := int(t) / 3600
+	m := (int(t) % 3600) / 60
+	sec := t - float64(h*3600+m*60)
+	return strings.Replace(fmt.Sprintf("%02d:%02d:%06.3f", h, m, sec), ".", ",", 1)
+}
+
+func writeSRT(path string, cues []subtitleCue) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for i, cue := range cues {
+		fmt.Fprintf(w, "%d\n", i+1)
+		fmt.Fprintf(w, "%s --> %s\n", formatSRTTime(cue.start), formatSRTTime(cue.end))
+		fmt.Fprintln(w, cue.text)
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"strconv"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+// templateSpec configures one -t template: which image (and optional alpha
+// mask) to match, at what scales/rotations/method/threshold, and what
+// boxblur parameters to apply where it's found. A bare path with no
+// key=value pairs falls back to the global -boxblur/-threshold.
+type templateSpec struct {
+	path      string
+	maskPath  string
+	blur      string
+	threshold float64
+	scales    []float64
+	rotations []float64
+	method    gocv.TemplateMatchMode
+}
+
+// parseTemplateSpec parses one -t argument, either a bare file path or a
+// "key=value;key=value" spec, e.g.:
+// "file=logo.png;blur=30;threshold=0.85;scales=0.75,1.0,1.25;method=ccorr_normed;mask=logo_mask.png"
+func parseTemplateSpec(s, defaultBlur string, defaultThreshold float64) (templateSpec, error) {
+	spec := templateSpec{
+		blur:      defaultBlur,
+		threshold: defaultThreshold,
+		scales:    []float64{1.0},
+		rotations: []float64{0},
+		method:    gocv.TmCcoeffNormed,
+	}
+	if !strings.Contains(s, "=") {
+		spec.path = s
+		return spec, nil
+	}
+	for _, field := range strings.Split(s, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return spec, fmt.Errorf("invalid -t spec field: %q", field)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "file":
+			spec.path = val
+		case "mask":
+			spec.maskPath = val
+		case "blur":
+			spec.blur = val
+		case "threshold":
+			spec.threshold, err = strconv.ParseFloat(val, 64)
+		case "scales":
+			spec.scales, err = parseFloatList(val)
+		case "rotations":
+			spec.rotations, err = parseFloatList(val)
+		case "method":
+			spec.method, err = parseMatchMethod(val)
+		default:
+			err = fmt.Errorf("unknown -t spec field: %q", key)
+		}
+		if err != nil {
+			return spec, err
+		}
+	}
+	if spec.path == "" {
+		return spec, fmt.Errorf("-t spec is missing file=: %q", s)
+	}
+	return spec, nil
+}
+
+func parseFloatList(s string) ([]float64, error) {
+	var out []float64
+	for _, v := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %q", v)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func parseMatchMethod(name string) (gocv.TemplateMatchMode, error) {
+	switch name {
+	case "sqdiff":
+		return gocv.TmSqdiff, nil
+	case "sqdiff_normed":
+		return gocv.TmSqdiffNormed, nil
+	case "ccorr":
+		return gocv.TmCcorr, nil
+	case "ccorr_normed":
+		return gocv.TmCcorrNormed, nil
+	case "ccoeff":
+		return gocv.TmCcoeff, nil
+	case "ccoeff_normed":
+		return gocv.TmCcoeffNormed, nil
+	default:
+		return 0, fmt.Errorf("unknown -t match method: %q", name)
+	}
+}
+
+// templateVariant is one scaled/rotated rendition of a template image,
+// tried in turn at match time; width/height track its own size since
+// scaling changes it. mask is the same scale/rotation applied to the
+// template's alpha mask (if any), since gocv.MatchTemplate requires the
+// mask to be exactly the size of the template it's matched against.
+type templateVariant struct {
+	mat    gocv.Mat
+	mask   gocv.Mat
+	width  int
+	height int
+}
+
+// loadedTemplate is a parsed templateSpec plus its image pyramid (every
+// scale/rotation combination, mask included), ready for matching.
+type loadedTemplate struct {
+	spec     templateSpec
+	variants []templateVariant
+}
+
+// loadTemplates reads every templateSpec's image (and mask, if any) and
+// builds their scale/rotation pyramid, keeping each mask variant aligned
+// with the template variant it matches.
+func loadTemplates(specs []templateSpec) ([]*loadedTemplate, error) {
+	loaded := make([]*loadedTemplate, 0, len(specs))
+	for _, spec := range specs {
+		base := gocv.IMRead(spec.path, gocv.IMReadGrayScale)
+		if base.Empty() {
+			return nil, fmt.Errorf("invalid template file: %s", spec.path)
+		}
+		baseMask := gocv.NewMat()
+		if spec.maskPath != "" {
+			baseMask.Close()
+			baseMask = gocv.IMRead(spec.maskPath, gocv.IMReadGrayScale)
+			if baseMask.Empty() {
+				return nil, fmt.Errorf("invalid mask file: %s", spec.maskPath)
+			}
+		}
+		lt := &loadedTemplate{spec: spec}
+		for _, scale := range spec.scales {
+			scaled := base
+			scaledMask := baseMask
+			if scale != 1.0 {
+				scaled = gocv.NewMat()
+				gocv.Resize(base, &scaled, image.Point{}, scale, scale, gocv.InterpolationLinear)
+				if !baseMask.Empty() {
+					scaledMask = gocv.NewMat()
+					gocv.Resize(baseMask, &scaledMask, image.Point{}, scale, scale, gocv.InterpolationLinear)
+				}
+			}
+			for _, angle := range spec.rotations {
+				mat, mask := scaled, scaledMask
+				if angle != 0 {
+					mat = rotateMat(scaled, angle)
+					if !scaledMask.Empty() {
+						mask = rotateMat(scaledMask, angle)
+					}
+				}
+				lt.variants = append(lt.variants, templateVariant{
+					mat:    mat,
+					mask:   mask,
+					width:  mat.Cols(),
+					height: mat.Rows(),
+				})
+			}
+		}
+		loaded = append(loaded, lt)
+		log.Printf("loaded template %s: %d scale(s), %d rotation(s), %d variant(s)",
+			spec.path, len(spec.scales), len(spec.rotations), len(lt.variants))
+	}
+	return loaded, nil
+}
+
+// rotateMat returns src rotated by angle degrees around its center.
+func rotateMat(src gocv.Mat, angle float64) gocv.Mat {
+	center := image.Pt(src.Cols()/2, src.Rows()/2)
+	rot := gocv.GetRotationMatrix2D(center, angle, 1.0)
+	defer rot.Close()
+	dst := gocv.NewMat()
+	gocv.WarpAffine(src, &dst, rot, image.Pt(src.Cols(), src.Rows()))
+	return dst
+}
+
+// Close releases every Mat owned by this template.
+func (lt *loadedTemplate) Close() {
+	for _, v := range lt.variants {
+		v.mat.Close()
+		if !v.mask.Empty() {
+			v.mask.Close()
+		}
+	}
+}